@@ -0,0 +1,509 @@
+package noisesocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxRecordPayload is the largest payload accepted in a single
+// transport record, matching the 2-byte length prefix used on the wire.
+const maxRecordPayload = 65535
+
+// recordHeaderLen is the size of the type and length fields that
+// precede every inner record's payload and padding.
+const recordHeaderLen = 1 + 2
+
+// Record types carried in the first plaintext byte of every transport
+// record, sealed under the same AEAD as the payload so an observer
+// can't tell a rekey or a keep-alive from ordinary traffic.
+const (
+	recordTypeData uint8 = iota
+	recordTypeRekey
+	recordTypeKeepAlive
+)
+
+// Defaults for ConnectionConfig.RekeyAfterBytes/RekeyAfterMessages,
+// chosen to stay well under ChaCha20-Poly1305's practical single-key
+// limits for a connection that runs indefinitely.
+const (
+	defaultRekeyAfterBytes    = 1 << 30 // 1 GiB
+	defaultRekeyAfterMessages = 1 << 28
+)
+
+// compressionMinSize is the smallest chunk Write will ever compress.
+// Compressing short, possibly attacker-influenced records alongside
+// secrets is how compression-oracle attacks like CRIME work, so below
+// this size a record is always sent as-is regardless of negotiation.
+const compressionMinSize = 256
+
+// maxChunkLenFor returns the largest slice Write may seal into a single
+// record for a Conn configured with the given padding: maxRecordPayload,
+// less the AEAD tag, less whatever PadTo/PadBlockwise could round the
+// inner record up to, less the type+length header and the one-byte flag
+// compress always prepends (even when it leaves the chunk
+// uncompressed). With PadBlockwise, paddedLen rounds up to the next
+// multiple of padTo, which can push a chunk sized for the unpadded case
+// past the wire limit; clamping to the largest multiple of padTo that
+// still fits avoids that.
+func maxChunkLenFor(padTo int, padBlockwise bool) int {
+	limit := maxRecordPayload - tagLen
+
+	if padBlockwise && padTo > 0 && padTo <= limit {
+		limit = (limit / padTo) * padTo
+	}
+
+	maxChunk := limit - recordHeaderLen - 1
+
+	if maxChunk < 0 {
+		return 0
+	}
+
+	return maxChunk
+}
+
+// Conn is a net.Conn that carries its payload inside a Noise transport
+// session established by Dial or by a Listener returned from Listen.
+type Conn struct {
+	conn net.Conn
+
+	send *noise.CipherState
+	recv *noise.CipherState
+
+	version uint16
+
+	handshakeHash [32]byte
+	peerStatic    []byte
+
+	rekeyAfterBytes    uint64
+	rekeyAfterMessages uint64
+	sendBytes          uint64
+	sendMessages       uint64
+
+	compression Compression
+	zEncoder    *zstd.Encoder
+	zDecoder    *zstd.Decoder
+
+	padTo        int
+	padBlockwise bool
+	chunkLen     int
+
+	writeMu           sync.Mutex
+	lastWrite         int64 // unix nanoseconds, written atomically
+	keepAliveInterval time.Duration
+	stopKeepAlive     chan struct{}
+	closeOnce         sync.Once
+
+	readBuf []byte // undelivered plaintext left over from the last Read
+}
+
+func newConn(conn net.Conn, send, recv *noise.CipherState, version uint16, handshakeHash [32]byte, peerStatic []byte, config *ConnectionConfig, compression Compression) *Conn {
+	rekeyAfterBytes := uint64(config.RekeyAfterBytes)
+	if rekeyAfterBytes == 0 {
+		rekeyAfterBytes = defaultRekeyAfterBytes
+	}
+
+	rekeyAfterMessages := uint64(config.RekeyAfterMessages)
+	if rekeyAfterMessages == 0 {
+		rekeyAfterMessages = defaultRekeyAfterMessages
+	}
+
+	c := &Conn{
+		conn:               conn,
+		send:               send,
+		recv:               recv,
+		version:            version,
+		handshakeHash:      handshakeHash,
+		peerStatic:         peerStatic,
+		rekeyAfterBytes:    rekeyAfterBytes,
+		rekeyAfterMessages: rekeyAfterMessages,
+		compression:        compression,
+		padTo:              config.PadTo,
+		padBlockwise:       config.PadBlockwise,
+		chunkLen:           maxChunkLenFor(config.PadTo, config.PadBlockwise),
+		keepAliveInterval:  config.KeepAliveInterval,
+	}
+
+	if compression == CompressionZstd {
+		// Encoder/decoder are created once and reused for every
+		// record instead of per write/read, which is where zstd's
+		// setup cost (window and table allocation) actually lives.
+		c.zEncoder, _ = zstd.NewWriter(nil)
+
+		// WithDecoderMaxMemory bounds DecodeAll's own output, not just
+		// the capacity hint decompress passes it: DecodeAll ignores
+		// dst's capacity and keeps appending until the stream ends, so
+		// without this a peer's claimed origLen is not what actually
+		// limits how much memory a single record can make us allocate.
+		c.zDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxRecordPayload))
+	}
+
+	if c.keepAliveInterval > 0 {
+		c.stopKeepAlive = make(chan struct{})
+		go c.keepAliveLoop()
+	}
+
+	return c
+}
+
+// Version returns the protocol version negotiated during the handshake.
+func (c *Conn) Version() uint16 { return c.version }
+
+// HandshakeHash returns the Noise handshake hash captured via
+// ChannelBinding() when the handshake completed. Both peers compute the
+// same value, so it can be signed or HMAC'd to bind higher-level
+// requests to this specific session (the standard Noise channel-binding
+// idiom), without trusting the transport to do that on its own.
+func (c *Conn) HandshakeHash() [32]byte { return c.handshakeHash }
+
+// PeerStatic returns the remote peer's static public key as presented
+// during the handshake.
+func (c *Conn) PeerStatic() []byte { return c.peerStatic }
+
+func writeRecord(conn net.Conn, b []byte) error {
+	if len(b) > maxRecordPayload {
+		return errors.New("noisesocket: record too large")
+	}
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(b)))
+
+	if _, err := conn.Write(length); err != nil {
+		return err
+	}
+
+	_, err := conn.Write(b)
+	return err
+}
+
+func readRecord(conn net.Conn) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// Read implements net.Conn by decrypting one transport record at a
+// time, buffering any plaintext the caller's slice couldn't hold.
+// Rekey and keep-alive control records are consumed transparently and
+// never surfaced to the caller.
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		ciphertext, err := readRecord(c.conn)
+
+		if err != nil {
+			return 0, err
+		}
+
+		plaintext, err := c.recv.Decrypt(nil, nil, ciphertext)
+
+		if err != nil {
+			return 0, err
+		}
+
+		typ, body, err := parseFrame(plaintext)
+
+		if err != nil {
+			return 0, err
+		}
+
+		switch typ {
+		case recordTypeRekey:
+			c.recv.Rekey()
+			continue
+		case recordTypeKeepAlive:
+			continue
+		}
+
+		payload, err := c.decompress(body)
+
+		if err != nil {
+			return 0, err
+		}
+
+		c.readBuf = payload
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	return n, nil
+}
+
+// Write implements net.Conn by sealing b into one or more transport
+// records, splitting it if it doesn't fit in a single record. Once
+// enough bytes or messages have been sent, it rotates the send key and
+// tells the peer to rotate its matching receive key on the same
+// message boundary via an in-band rekey record, so the key change
+// never needs its own out-of-band signal.
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > c.chunkLen {
+			chunk = chunk[:c.chunkLen]
+		}
+
+		body := c.compress(chunk)
+
+		if err := c.writeRecord(recordTypeData, body); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// paddedLen returns the inner record length (header + body + pad) for
+// a body of the given length, given this Conn's padding configuration.
+func (c *Conn) paddedLen(bodyLen int) int {
+	inner := recordHeaderLen + bodyLen
+
+	switch {
+	case c.padTo <= 0:
+		return inner
+	case c.padBlockwise:
+		return ((inner + c.padTo - 1) / c.padTo) * c.padTo
+	case c.padTo > inner:
+		return c.padTo
+	default:
+		return inner
+	}
+}
+
+// frame builds the inner, pre-AEAD record: type(1) | len(2) | body |
+// pad. The receiver trusts len and discards the pad, which is just
+// zero bytes out to the target size computed by paddedLen.
+func frame(typ uint8, body []byte, target int) []byte {
+	plaintext := make([]byte, target)
+	plaintext[0] = typ
+	binary.BigEndian.PutUint16(plaintext[1:3], uint16(len(body)))
+	copy(plaintext[recordHeaderLen:], body)
+
+	return plaintext
+}
+
+// parseFrame is the inverse of frame: it trusts the embedded length
+// and ignores anything past it, which is how the pad is discarded.
+func parseFrame(plaintext []byte) (typ uint8, body []byte, err error) {
+	if len(plaintext) < recordHeaderLen {
+		return 0, nil, errors.New("noisesocket: short record")
+	}
+
+	n := binary.BigEndian.Uint16(plaintext[1:3])
+
+	if int(n) > len(plaintext)-recordHeaderLen {
+		return 0, nil, errors.New("noisesocket: invalid record length")
+	}
+
+	return plaintext[0], plaintext[recordHeaderLen : recordHeaderLen+int(n)], nil
+}
+
+// compress frames chunk as [1|origLenVarint|zstdBytes] when it
+// compresses it and as [0|chunk] when it doesn't, compressing with
+// zstd only when compression was negotiated and
+// chunk is large enough that doing so isn't a compression-oracle risk.
+// Incompressible input can come out of zstd larger than it went in; if
+// that growth would push the record past what writeRecord can send,
+// compress falls back to the uncompressed framing, which Write has
+// already sized to always fit.
+func (c *Conn) compress(chunk []byte) []byte {
+	uncompressed := append([]byte{0}, chunk...)
+
+	if c.compression != CompressionZstd || len(chunk) < compressionMinSize {
+		return uncompressed
+	}
+
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(chunk)))
+
+	out := append([]byte{1}, length[:n]...)
+	compressed := c.zEncoder.EncodeAll(chunk, out)
+
+	if c.paddedLen(len(compressed))+tagLen > maxRecordPayload {
+		return uncompressed
+	}
+
+	return compressed
+}
+
+// decompress is the inverse of compress. origLen comes from the peer
+// and only sizes the capacity hint passed to DecodeAll, which ignores
+// that capacity and keeps writing until the stream ends; the actual
+// bound on how much a single record can make us allocate is zDecoder's
+// own WithDecoderMaxMemory(maxRecordPayload), set when it was created.
+// origLen itself is still checked, both to reject an obviously bogus
+// claim before touching the decoder and to catch a peer whose claimed
+// and actual lengths disagree.
+func (c *Conn) decompress(body []byte) ([]byte, error) {
+	if len(body) < 1 {
+		return nil, errors.New("noisesocket: empty record body")
+	}
+
+	flag, rest := body[0], body[1:]
+
+	if flag == 0 {
+		return rest, nil
+	}
+
+	origLen, n := binary.Uvarint(rest)
+
+	if n <= 0 {
+		return nil, errors.New("noisesocket: invalid compressed record length")
+	}
+
+	if origLen > maxRecordPayload {
+		return nil, errors.New("noisesocket: compressed record claims an impossible length")
+	}
+
+	out, err := c.zDecoder.DecodeAll(rest[n:], make([]byte, 0, origLen))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(out)) != origLen {
+		return nil, errors.New("noisesocket: decompressed length does not match the claimed length")
+	}
+
+	return out, nil
+}
+
+// writeRecord seals typ and body, padded per the Conn's configuration,
+// into one transport record and writes it to the underlying
+// connection. It serializes against concurrent writers, since the
+// keep-alive goroutine writes on the same connection, and holds that
+// same lock across the rekey check so a concurrent Write can never
+// observe or act on sendBytes/sendMessages mid-update.
+func (c *Conn) writeRecord(typ uint8, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.writeRecordLocked(typ, body)
+}
+
+// writeRecordLocked is writeRecord's body, callable by code that
+// already holds writeMu (maybeRekeyLocked writes its rekey record this
+// way).
+func (c *Conn) writeRecordLocked(typ uint8, body []byte) error {
+	target := c.paddedLen(len(body))
+
+	if target+tagLen > maxRecordPayload {
+		return errors.New("noisesocket: padded record too large")
+	}
+
+	plaintext := frame(typ, body, target)
+
+	ciphertext, err := c.send.Encrypt(nil, nil, plaintext)
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeRecord(c.conn, ciphertext); err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+
+	if typ != recordTypeData {
+		return nil
+	}
+
+	c.sendBytes += uint64(len(body))
+	c.sendMessages++
+
+	return c.maybeRekeyLocked()
+}
+
+// keepAliveLoop sends an empty, padded record whenever the connection
+// has gone a full interval without a write, so an observer watching
+// record sizes and timing can't tell idle cover traffic from real but
+// infrequent application data. It exits the first time that write
+// fails, since a dead connection can only ever fail the same way again,
+// and nothing else would otherwise stop it from retrying forever if the
+// caller never gets around to calling Close.
+func (c *Conn) keepAliveLoop() {
+	ticker := time.NewTicker(c.keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastWrite)))
+
+			if idle >= c.keepAliveInterval {
+				if err := c.writeRecord(recordTypeKeepAlive, nil); err != nil {
+					return
+				}
+			}
+		case <-c.stopKeepAlive:
+			return
+		}
+	}
+}
+
+// maybeRekeyLocked rotates the send key and notifies the peer once the
+// configured byte or message thresholds have been reached. Callers must
+// hold writeMu, which keeps the threshold check, the rekey record, and
+// the counter reset atomic with respect to concurrent Writes.
+func (c *Conn) maybeRekeyLocked() error {
+	if c.sendBytes < c.rekeyAfterBytes && c.sendMessages < c.rekeyAfterMessages {
+		return nil
+	}
+
+	if err := c.writeRecordLocked(recordTypeRekey, nil); err != nil {
+		return err
+	}
+
+	c.send.Rekey()
+	c.sendBytes = 0
+	c.sendMessages = 0
+
+	return nil
+}
+
+func (c *Conn) Close() error {
+	// Close is commonly called more than once (defer plus an early
+	// explicit call, multiple error-exit paths); closeOnce keeps the
+	// one-time teardown below from panicking on the second call.
+	c.closeOnce.Do(func() {
+		if c.stopKeepAlive != nil {
+			close(c.stopKeepAlive)
+		}
+
+		if c.zEncoder != nil {
+			c.zEncoder.Close()
+		}
+
+		if c.zDecoder != nil {
+			c.zDecoder.Close()
+		}
+	})
+
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
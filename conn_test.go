@@ -0,0 +1,278 @@
+package noisesocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingConn is a net.Conn whose every Write fails, used to simulate a
+// dead underlying connection without tearing down the Conn itself.
+type failingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (f *failingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&f.writes, 1)
+	return 0, errors.New("failingConn: write refused")
+}
+
+// TestRekeyBoundaryIntegrity drives enough traffic across a connection
+// configured with tiny rekey thresholds to force many key rotations,
+// then checks every byte still arrives intact. A low threshold is used
+// instead of the multi-gigabyte volume needed to actually exhaust a
+// ChaCha20-Poly1305 key, since what's under test is the rekey/read
+// boundary bookkeeping, not the cipher's key lifetime.
+func TestRekeyBoundaryIntegrity(t *testing.T) {
+	config := func() *ConnectionConfig {
+		return &ConnectionConfig{
+			StaticKey:          generateKeypair(t),
+			RekeyAfterBytes:    4096,
+			RekeyAfterMessages: 8,
+		}
+	}
+
+	client, server := dialAndAccept(t, config(), config())
+	defer client.Close()
+	defer server.Close()
+
+	const total = 256 * 1024
+	want := make([]byte, total)
+
+	if _, err := rand.Read(want); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		_, err := client.Write(want)
+		errCh <- err
+	}()
+
+	got := make([]byte, total)
+
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatal("data corrupted across a rekey boundary")
+	}
+}
+
+// TestConcurrentWritesTriggerRekey has several goroutines call Write
+// concurrently against a Conn with a rekey threshold low enough that
+// nearly every write crosses it, so that under -race any unsynchronized
+// access to the rekey bookkeeping or to the send cipher shows up.
+func TestConcurrentWritesTriggerRekey(t *testing.T) {
+	client, server := dialAndAccept(t,
+		&ConnectionConfig{StaticKey: generateKeypair(t), RekeyAfterMessages: 1},
+		&ConnectionConfig{StaticKey: generateKeypair(t), RekeyAfterMessages: 1},
+	)
+
+	defer client.Close()
+	defer server.Close()
+
+	const writers = 8
+	const perWriter = 32
+
+	var wg sync.WaitGroup
+
+	go func() {
+		sink := make([]byte, 64)
+		for {
+			if _, err := server.Read(sink); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			msg := []byte("concurrent writer traffic")
+
+			for j := 0; j < perWriter; j++ {
+				if _, err := client.Write(msg); err != nil {
+					t.Errorf("Write: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// TestCompressionNegotiation checks that compression only takes effect
+// when both peers ask for it, and that data survives the round trip
+// either way.
+func TestCompressionNegotiation(t *testing.T) {
+	cases := []struct {
+		name            string
+		client, server  Compression
+		wantCompression Compression
+	}{
+		{"both zstd", CompressionZstd, CompressionZstd, CompressionZstd},
+		{"client only", CompressionZstd, CompressionNone, CompressionNone},
+		{"server only", CompressionNone, CompressionZstd, CompressionNone},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := dialAndAccept(t,
+				&ConnectionConfig{StaticKey: generateKeypair(t), Compression: tc.client},
+				&ConnectionConfig{StaticKey: generateKeypair(t), Compression: tc.server},
+			)
+
+			defer client.Close()
+			defer server.Close()
+
+			if client.compression != tc.wantCompression || server.compression != tc.wantCompression {
+				t.Fatalf("got compression client=%v server=%v, want %v", client.compression, server.compression, tc.wantCompression)
+			}
+
+			payload := bytes.Repeat([]byte("compress me please "), 100)
+			roundTrip(t, client, server, payload)
+		})
+	}
+}
+
+// TestDecompressRejectsOversizedStream forges a record whose flag byte
+// claims compression and whose varint-encoded origLen is tiny, but
+// whose actual zstd stream decodes to far more than that: DecodeAll
+// ignores the capacity of the buffer it's given and keeps writing until
+// the stream ends, so origLen alone can't be trusted to bound the
+// output. decompress must refuse it rather than hand back (or crash
+// allocating) an oversized buffer.
+func TestDecompressRejectsOversizedStream(t *testing.T) {
+	client, server := dialAndAccept(t,
+		&ConnectionConfig{StaticKey: generateKeypair(t), Compression: CompressionZstd},
+		&ConnectionConfig{StaticKey: generateKeypair(t), Compression: CompressionZstd},
+	)
+
+	defer client.Close()
+	defer server.Close()
+
+	large := make([]byte, 8*1024*1024)
+	compressed := client.zEncoder.EncodeAll(large, nil)
+
+	forged := append([]byte{1, 1}, compressed...) // flag=1, origLen=1
+
+	if out, err := server.decompress(forged); err == nil {
+		t.Fatalf("expected decompress to reject a stream larger than its claimed length, got %d bytes", len(out))
+	}
+}
+
+// TestPadding checks that outgoing records are padded up to the
+// configured size and that the receiver still recovers the exact
+// original payload.
+func TestPadding(t *testing.T) {
+	client, server := dialAndAccept(t,
+		&ConnectionConfig{StaticKey: generateKeypair(t), PadTo: 512},
+		&ConnectionConfig{StaticKey: generateKeypair(t), PadTo: 512},
+	)
+
+	defer client.Close()
+	defer server.Close()
+
+	if got := client.paddedLen(len(client.compress([]byte("short")))); got != 512 {
+		t.Fatalf("padded record length = %d, want 512", got)
+	}
+
+	roundTrip(t, client, server, []byte("short"))
+}
+
+// TestPaddingBlockwiseAtMaxChunk checks that a maximally-sized Write
+// still succeeds under PadBlockwise, where paddedLen can round the
+// inner record up past the wire limit for a chunk sized only for the
+// unpadded case.
+func TestPaddingBlockwiseAtMaxChunk(t *testing.T) {
+	client, server := dialAndAccept(t,
+		&ConnectionConfig{StaticKey: generateKeypair(t), PadTo: 1024, PadBlockwise: true},
+		&ConnectionConfig{StaticKey: generateKeypair(t), PadTo: 1024, PadBlockwise: true},
+	)
+
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		sink := make([]byte, 65536)
+		for {
+			if _, err := server.Read(sink); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := bytes.Repeat([]byte{1}, client.chunkLen)
+
+	if _, err := client.Write(buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// TestKeepAlive checks that an idle Conn sends a keep-alive record on
+// its own, and that the peer consumes it without surfacing it to Read.
+func TestKeepAlive(t *testing.T) {
+	client, server := dialAndAccept(t,
+		&ConnectionConfig{StaticKey: generateKeypair(t), KeepAliveInterval: 10 * time.Millisecond},
+		&ConnectionConfig{StaticKey: generateKeypair(t)},
+	)
+
+	defer client.Close()
+	defer server.Close()
+
+	// The keep-alive fires while both ends are otherwise idle; a
+	// subsequent real write must still be exactly what was sent, with
+	// no leftover keep-alive bytes visible to the reader.
+	time.Sleep(50 * time.Millisecond)
+
+	roundTrip(t, client, server, []byte("still there"))
+}
+
+// TestKeepAliveStopsAfterWriteFailure checks that keepAliveLoop gives up
+// after its first failed write instead of retrying a doomed connection
+// forever.
+func TestKeepAliveStopsAfterWriteFailure(t *testing.T) {
+	client, server := dialAndAccept(t,
+		&ConnectionConfig{StaticKey: generateKeypair(t), KeepAliveInterval: 5 * time.Millisecond},
+		&ConnectionConfig{StaticKey: generateKeypair(t)},
+	)
+
+	defer server.Close()
+
+	fc := &failingConn{}
+
+	// Swap the underlying conn out from under writeMu, the same lock
+	// keepAliveLoop's writes take, so this doesn't race with a
+	// keep-alive that's already in flight.
+	client.writeMu.Lock()
+	client.conn = fc
+	client.writeMu.Unlock()
+
+	time.Sleep(30 * time.Millisecond)
+	first := atomic.LoadInt32(&fc.writes)
+
+	time.Sleep(50 * time.Millisecond)
+	second := atomic.LoadInt32(&fc.writes)
+
+	if second != first {
+		t.Fatalf("keepAliveLoop kept retrying after a write failure: %d writes, then %d more", first, second-first)
+	}
+}
@@ -0,0 +1,22 @@
+package noisesocket
+
+import "net"
+
+// Dial connects to the given address and performs a Noise Socket
+// initiator handshake before returning the resulting Conn.
+func Dial(address string, config *ConnectionConfig) (net.Conn, error) {
+	conn, err := net.Dial("tcp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dialHandshake(conn, config)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
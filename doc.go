@@ -0,0 +1,8 @@
+// Package noisesocket provides net.Conn-compatible transport security
+// built on top of the Noise Protocol Framework (https://noiseprotocol.org).
+//
+// A Conn is obtained the same way as a plain TCP connection, via Dial
+// and Listen, but every byte written to or read from it is carried
+// inside a Noise handshake and transport session instead of cleartext
+// TCP.
+package noisesocket
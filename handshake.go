@@ -0,0 +1,287 @@
+package noisesocket
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/flynn/noise"
+)
+
+// tagLen is the size in bytes of the AEAD authentication tag appended
+// by every cipher this package supports.
+const tagLen = 16
+
+// supportedVersions lists the protocol versions this build understands,
+// newest first. highestSupportedVersion is what a responder advertises
+// when it has to reject an offer.
+var supportedVersions = []uint16{CurrentVersion}
+
+func highestSupportedVersion() uint16 {
+	return supportedVersions[0]
+}
+
+func versionSupported(v uint16) bool {
+	for _, sv := range supportedVersions {
+		if sv == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// noisePattern returns the Noise handshake pattern for a header's
+// pattern byte, and an error if it isn't one this build understands.
+func noisePattern(p uint8) (noise.HandshakePattern, error) {
+	switch p {
+	case patternXX:
+		return noise.HandshakeXX, nil
+	case patternIK:
+		return noise.HandshakeIK, nil
+	default:
+		return noise.HandshakePattern{}, fmt.Errorf("noisesocket: unknown handshake pattern %d", p)
+	}
+}
+
+// message1Len returns the length of the first handshake message for a
+// pattern, which a dialer must know before it can build the header
+// that precedes that message. It assumes IK's message 1 carries the
+// 2-byte compression offer as its payload; see compressionOffer.
+func message1Len(p uint8, suite noise.CipherSuite) int {
+	dhLen := suite.DHLen()
+
+	switch p {
+	case patternIK:
+		// e, es, s (encrypted under the es key), ss, and an encrypted
+		// 2-byte compression offer: e | s+tag | offer+tag.
+		return dhLen + dhLen + tagLen + 2 + tagLen
+	default:
+		// XX's first message is a bare, unencrypted ephemeral key.
+		return dhLen
+	}
+}
+
+// compressionOffer is the payload a peer attaches to any handshake
+// message it sends once a Noise key is established: its requested
+// Compression scheme, followed by a reserved dictionary-id byte
+// (always 0 today, kept for a future dictionary negotiation).
+func compressionOffer(c Compression) []byte {
+	return []byte{uint8(c), 0}
+}
+
+// negotiateCompression only turns compression on when both peers asked
+// for the same scheme; anything else silently falls back to none.
+func negotiateCompression(mine Compression, peerPayload []byte) Compression {
+	if mine == CompressionNone || len(peerPayload) < 1 {
+		return CompressionNone
+	}
+
+	if Compression(peerPayload[0]) == mine {
+		return mine
+	}
+
+	return CompressionNone
+}
+
+// dialHandshake runs the initiator side of the handshake: Noise IK
+// against a pinned key when config.PeerStatic is set, Noise XX
+// otherwise. Both patterns are prefixed with a version/pattern header
+// on their first message in each direction so a peer can reject an
+// unsupported offer, or a listener can dispatch between patterns,
+// before any Noise state is touched.
+func dialHandshake(conn net.Conn, config *ConnectionConfig) (*Conn, error) {
+	version := config.Version
+	if version == 0 {
+		version = CurrentVersion
+	}
+
+	pattern := patternXX
+	if config.PeerStatic != nil {
+		pattern = patternIK
+	}
+
+	hsPattern, err := noisePattern(pattern)
+
+	if err != nil {
+		return nil, err
+	}
+
+	suite := cipherSuite()
+
+	h := header{version: version, pattern: pattern, payloadLen: uint16(message1Len(pattern, suite))}
+	prologue := h.bytes()
+
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   suite,
+		Pattern:       hsPattern,
+		Initiator:     true,
+		Prologue:      prologue,
+		StaticKeypair: config.StaticKey,
+		PeerStatic:    config.PeerStatic,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var msg1Payload []byte
+	if pattern == patternIK {
+		// XX's message 1 has no key yet to encrypt a payload under.
+		msg1Payload = compressionOffer(config.Compression)
+	}
+
+	msg1, _, _, err := hs.WriteMessage(nil, msg1Payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if uint16(len(msg1)) != h.payloadLen {
+		return nil, fmt.Errorf("noisesocket: unexpected handshake message 1 length %d", len(msg1))
+	}
+
+	if _, err := conn.Write(append(prologue, msg1...)); err != nil {
+		return nil, err
+	}
+
+	replyHeaderBytes := make([]byte, headerSize)
+
+	if _, err := io.ReadFull(conn, replyHeaderBytes); err != nil {
+		return nil, err
+	}
+
+	replyHeader, err := parseHeader(replyHeaderBytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if replyHeader.payloadLen == 0 {
+		return nil, fmt.Errorf("%w: responder supports up to version %d", ErrUnsupportedVersion, replyHeader.version)
+	}
+
+	msg2 := make([]byte, replyHeader.payloadLen)
+
+	if _, err := io.ReadFull(conn, msg2); err != nil {
+		return nil, err
+	}
+
+	payload2, cs1, cs2, err := hs.ReadMessage(nil, msg2)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cs1 == nil {
+		// XX needs a third message; IK is already done after message 2.
+		var msg3 []byte
+
+		msg3, cs1, cs2, err = hs.WriteMessage(nil, compressionOffer(config.Compression))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeRecord(conn, msg3); err != nil {
+			return nil, err
+		}
+	}
+
+	var handshakeHash [32]byte
+	copy(handshakeHash[:], hs.ChannelBinding())
+
+	compression := negotiateCompression(config.Compression, payload2)
+
+	return newConn(conn, cs1, cs2, version, handshakeHash, hs.PeerStatic(), config, compression), nil
+}
+
+// acceptHandshake runs the responder side of the handshake. It reads
+// the header before creating any Noise state, both to reject a bad
+// magic/version cheaply and to decide whether the offer is XX or IK,
+// so a single listener can serve both on one port.
+func acceptHandshake(conn net.Conn, config *ConnectionConfig) (*Conn, error) {
+	headerBytes := make([]byte, headerSize)
+
+	if _, err := io.ReadFull(conn, headerBytes); err != nil {
+		return nil, err
+	}
+
+	h, err := parseHeader(headerBytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !versionSupported(h.version) {
+		reject := header{version: highestSupportedVersion(), payloadLen: 0}
+		conn.Write(reject.bytes())
+		return nil, fmt.Errorf("%w: offered version %d", ErrUnsupportedVersion, h.version)
+	}
+
+	hsPattern, err := noisePattern(h.pattern)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg1 := make([]byte, h.payloadLen)
+
+	if _, err := io.ReadFull(conn, msg1); err != nil {
+		return nil, err
+	}
+
+	suite := cipherSuite()
+
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   suite,
+		Pattern:       hsPattern,
+		Initiator:     false,
+		Prologue:      headerBytes,
+		StaticKeypair: config.StaticKey,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	payload1, _, _, err := hs.ReadMessage(nil, msg1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg2, cs1, cs2, err := hs.WriteMessage(nil, compressionOffer(config.Compression))
+
+	if err != nil {
+		return nil, err
+	}
+
+	reply := header{version: h.version, pattern: h.pattern, payloadLen: uint16(len(msg2))}
+
+	if _, err := conn.Write(append(reply.bytes(), msg2...)); err != nil {
+		return nil, err
+	}
+
+	peerPayload := payload1
+
+	if cs1 == nil {
+		// XX needs a third message; IK is already done after message 2.
+		msg3, err := readRecord(conn)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if peerPayload, cs1, cs2, err = hs.ReadMessage(nil, msg3); err != nil {
+			return nil, err
+		}
+	}
+
+	var handshakeHash [32]byte
+	copy(handshakeHash[:], hs.ChannelBinding())
+
+	compression := negotiateCompression(config.Compression, peerPayload)
+
+	return newConn(conn, cs2, cs1, h.version, handshakeHash, hs.PeerStatic(), config, compression), nil
+}
@@ -0,0 +1,133 @@
+package noisesocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/flynn/noise"
+)
+
+func generateKeypair(t *testing.T) noise.DHKey {
+	t.Helper()
+
+	key, err := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	if err != nil {
+		t.Fatalf("GenerateKeypair: %v", err)
+	}
+
+	return key
+}
+
+// dialAndAccept runs dialHandshake and acceptHandshake against opposite
+// ends of a net.Pipe concurrently and returns both resulting Conns.
+func dialAndAccept(t *testing.T, dialConfig, acceptConfig *ConnectionConfig) (*Conn, *Conn) {
+	t.Helper()
+
+	client, server := net.Pipe()
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+
+	clientCh := make(chan result, 1)
+	serverCh := make(chan result, 1)
+
+	go func() {
+		c, err := dialHandshake(client, dialConfig)
+		clientCh <- result{c, err}
+	}()
+
+	go func() {
+		c, err := acceptHandshake(server, acceptConfig)
+		serverCh <- result{c, err}
+	}()
+
+	cr, sr := <-clientCh, <-serverCh
+
+	if cr.err != nil {
+		t.Fatalf("dialHandshake: %v", cr.err)
+	}
+
+	if sr.err != nil {
+		t.Fatalf("acceptHandshake: %v", sr.err)
+	}
+
+	return cr.conn, sr.conn
+}
+
+func TestHandshakeXX(t *testing.T) {
+	serverKey := generateKeypair(t)
+
+	client, server := dialAndAccept(t,
+		&ConnectionConfig{StaticKey: generateKeypair(t)},
+		&ConnectionConfig{StaticKey: serverKey},
+	)
+
+	defer client.Close()
+	defer server.Close()
+
+	if client.HandshakeHash() != server.HandshakeHash() {
+		t.Fatal("client and server disagree on the handshake hash")
+	}
+
+	if !bytes.Equal(client.PeerStatic(), serverKey.Public) {
+		t.Fatal("client did not learn the server's static key")
+	}
+
+	roundTrip(t, client, server, []byte("hello over XX"))
+}
+
+func TestHandshakeIK(t *testing.T) {
+	clientKey := generateKeypair(t)
+	serverKey := generateKeypair(t)
+
+	client, server := dialAndAccept(t,
+		&ConnectionConfig{StaticKey: clientKey, PeerStatic: serverKey.Public},
+		&ConnectionConfig{StaticKey: serverKey},
+	)
+
+	defer client.Close()
+	defer server.Close()
+
+	if client.HandshakeHash() != server.HandshakeHash() {
+		t.Fatal("client and server disagree on the handshake hash")
+	}
+
+	if !bytes.Equal(server.PeerStatic(), clientKey.Public) {
+		t.Fatal("server did not learn the client's static key")
+	}
+
+	roundTrip(t, client, server, []byte("hello over IK"))
+}
+
+// roundTrip writes b from one Conn and reads it back from the other,
+// failing the test if the bytes don't match exactly.
+func roundTrip(t *testing.T, from, to *Conn, b []byte) {
+	t.Helper()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		_, err := from.Write(b)
+		errCh <- err
+	}()
+
+	got := make([]byte, len(b))
+
+	if _, err := io.ReadFull(to, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if !bytes.Equal(got, b) {
+		t.Fatalf("round trip mismatch: got %q, want %q", got, b)
+	}
+}
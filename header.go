@@ -0,0 +1,54 @@
+package noisesocket
+
+import "encoding/binary"
+
+// magic identifies the first bytes of a handshake record. It lets a
+// responder reject a connection that isn't speaking this protocol
+// before it ever touches the Noise state machine.
+var magic = [4]byte{'N', 'S', 'K', 't'}
+
+// headerSize is the length in bytes of the header that precedes the
+// first handshake message in each direction (and makes up a version
+// rejection on its own): magic(4) | version(2) | pattern(1) | payloadLen(2).
+const headerSize = 4 + 2 + 1 + 2
+
+// Handshake patterns a listener can dispatch to, identified by the
+// header's pattern byte so both XX and IK connections can share a port.
+const (
+	patternXX uint8 = iota
+	patternIK
+)
+
+// header is the fixed-size record that precedes the first Noise
+// handshake message in both directions. The initiator's header bytes
+// are fed verbatim into the Noise prologue on both sides, so a MITM
+// that tampers with the offered version or pattern is caught by the
+// handshake MAC rather than by this code; the responder's reply header
+// is not part of the prologue. The pattern byte also lets a listener tell an XX offer
+// from an IK offer before any Noise state is created.
+type header struct {
+	version    uint16
+	pattern    uint8
+	payloadLen uint16
+}
+
+func (h header) bytes() []byte {
+	b := make([]byte, headerSize)
+	copy(b, magic[:])
+	binary.BigEndian.PutUint16(b[4:], h.version)
+	b[6] = h.pattern
+	binary.BigEndian.PutUint16(b[7:], h.payloadLen)
+	return b
+}
+
+func parseHeader(b []byte) (header, error) {
+	if len(b) != headerSize || string(b[:4]) != string(magic[:]) {
+		return header{}, ErrBadMagic
+	}
+
+	return header{
+		version:    binary.BigEndian.Uint16(b[4:6]),
+		pattern:    b[6],
+		payloadLen: binary.BigEndian.Uint16(b[7:9]),
+	}, nil
+}
@@ -0,0 +1,40 @@
+package noisesocket
+
+import "net"
+
+type listener struct {
+	ln     net.Listener
+	config *ConnectionConfig
+}
+
+// Listen announces on the local network address and wraps the accepted
+// TCP connections in a Noise Socket responder handshake.
+func Listen(address string, config *ConnectionConfig) (net.Listener, error) {
+	ln, err := net.Listen("tcp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &listener{ln: ln, config: config}, nil
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.ln.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := acceptHandshake(conn, l.config)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (l *listener) Close() error   { return l.ln.Close() }
+func (l *listener) Addr() net.Addr { return l.ln.Addr() }
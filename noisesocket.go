@@ -0,0 +1,90 @@
+package noisesocket
+
+import (
+	"errors"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// CurrentVersion is the protocol version this package negotiates by
+// default when ConnectionConfig.Version is left unset.
+const CurrentVersion uint16 = 1
+
+var (
+	// ErrBadMagic is returned when the header at the start of a
+	// handshake record does not carry the expected magic bytes,
+	// meaning the peer is not speaking this protocol at all.
+	ErrBadMagic = errors.New("noisesocket: invalid handshake header")
+
+	// ErrUnsupportedVersion is returned by Dial when the responder
+	// rejects the version offered by the initiator.
+	ErrUnsupportedVersion = errors.New("noisesocket: responder does not support the offered protocol version")
+)
+
+// ConnectionConfig carries the parameters needed to establish a Noise
+// Socket connection, both for Dial and for Listen.
+type ConnectionConfig struct {
+	// StaticKey is the local static keypair used during the handshake.
+	StaticKey noise.DHKey
+
+	// Version is the protocol version offered by a dialer. If zero,
+	// CurrentVersion is used. Listeners always advertise the highest
+	// version they support when rejecting an offer.
+	Version uint16
+
+	// PeerStatic pins the remote party's static public key. When set
+	// on a dialer, Dial performs a Noise IK handshake against it
+	// instead of XX, which completes in two handshake messages rather
+	// than three. The initiator's first message carries only the
+	// compression offer, not application data: Dial returns, and Write
+	// can send, only after the responder's reply has been read.
+	// Listeners ignore this field; they accept both XX and IK offers
+	// on the same port.
+	PeerStatic []byte
+
+	// RekeyAfterBytes and RekeyAfterMessages bound how much traffic is
+	// ever sent under one transport key before Conn rotates it via
+	// Noise's Rekey(). If zero, 1 GiB and 2^28 messages are used,
+	// respectively. Whichever threshold is hit first triggers the
+	// rekey.
+	RekeyAfterBytes    uint64
+	RekeyAfterMessages uint64
+
+	// Compression is offered during the handshake and only takes
+	// effect if both peers ask for the same scheme; it defaults to
+	// CompressionNone, so compression stays off unless both sides opt
+	// in.
+	Compression Compression
+
+	// PadTo, if non-zero, pads every outgoing record up to at least
+	// PadTo bytes (e.g. 512 or 1024) so their ciphertext length
+	// doesn't reveal the true payload size to an observer. Set
+	// PadBlockwise to pad to the next multiple of PadTo instead of to
+	// a fixed size, which bounds the overhead on large writes.
+	PadTo        int
+	PadBlockwise bool
+
+	// KeepAliveInterval, if non-zero, sends a padded, content-free
+	// record whenever the connection has been idle for that long, so
+	// an observer can't distinguish idle cover traffic from a real,
+	// if infrequent, exchange.
+	KeepAliveInterval time.Duration
+}
+
+// Compression identifies a payload compression scheme offered during
+// the handshake.
+type Compression uint8
+
+const (
+	// CompressionNone carries record payloads as-is. It is the default.
+	CompressionNone Compression = iota
+
+	// CompressionZstd compresses record payloads with zstd before
+	// sealing them, when the peer also asks for it.
+	CompressionZstd
+)
+
+func cipherSuite() noise.CipherSuite {
+	return noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+}